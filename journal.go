@@ -0,0 +1,229 @@
+/*
+ *   Queryguard - Simple 1:1 proxy for mongodb that prevents people from running queries that won't use indexes
+ *   Copyright (c) 2016 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// JournalOutcome classifies why a JournalRecord was written.
+type JournalOutcome string
+
+const (
+	JournalOutcomeRejected JournalOutcome = "rejected"
+	JournalOutcomeKilled   JournalOutcome = "killed"
+	JournalOutcomeSlow     JournalOutcome = "slow"
+)
+
+// JournalRecord is one entry in the query journal: enough to find and
+// understand a rejected, killed or slow query after the fact without
+// tailing logs.
+type JournalRecord struct {
+	Time            time.Time              `json:"time" bson:"time"`
+	RemoteAddr      string                 `json:"remoteAddr" bson:"remoteAddr"`
+	QueryID         string                 `json:"queryId,omitempty" bson:"queryId,omitempty"`
+	Database        string                 `json:"database" bson:"database"`
+	Collection      string                 `json:"collection" bson:"collection"`
+	Query           map[string]interface{} `json:"query" bson:"query"`
+	IndexField      string                 `json:"indexField,omitempty" bson:"indexField,omitempty"`
+	Outcome         JournalOutcome         `json:"outcome" bson:"outcome"`
+	DurationSeconds float64                `json:"durationSeconds,omitempty" bson:"durationSeconds,omitempty"`
+}
+
+// QueryJournal buffers JournalRecords on an in-memory ring and drains them
+// to a rotating directory of newline-delimited JSON files on a single
+// writer goroutine, so handleQueryRequest's hot path never blocks on disk
+// I/O. When the buffer is full, records are dropped and counted rather
+// than applying backpressure to the client.
+type QueryJournal struct {
+	dir         string
+	maxFiles    int
+	maxFileSize int64
+
+	slowThreshold time.Duration
+
+	mongoSink *mgo.Collection
+
+	records chan JournalRecord
+
+	mu      sync.Mutex
+	curFile *os.File
+	curSize int64
+}
+
+// NewQueryJournal creates a journal that writes newline-delimited JSON
+// files into dir, keeping at most maxFiles of them (oldest evicted first)
+// and rotating once the current file reaches maxFileSize bytes. bufferDepth
+// sizes the in-memory ring the hot path enqueues onto.
+func NewQueryJournal(dir string, bufferDepth, maxFiles int, maxFileSize int64, slowThreshold time.Duration) (*QueryJournal, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	j := &QueryJournal{
+		dir:           dir,
+		maxFiles:      maxFiles,
+		maxFileSize:   maxFileSize,
+		slowThreshold: slowThreshold,
+		records:       make(chan JournalRecord, bufferDepth),
+	}
+
+	go j.run()
+
+	return j, nil
+}
+
+// WithMongoSink forwards every record the journal writes to disk to a
+// second sink: a capped collection reached via the backchannel session,
+// for centralized review.
+func (j *QueryJournal) WithMongoSink(session *mgo.Session, database, collection string) {
+	j.mongoSink = session.Clone().DB(database).C(collection)
+}
+
+// Record enqueues a record for the writer goroutine, dropping it (and
+// counting the drop) if the buffer is full.
+func (j *QueryJournal) Record(r JournalRecord) {
+	if r.Time.IsZero() {
+		r.Time = time.Now()
+	}
+
+	select {
+	case j.records <- r:
+	default:
+		journalRecordsDropped.Inc()
+	}
+}
+
+// IsSlow reports whether duration exceeds the configured slow-query
+// threshold.
+func (j *QueryJournal) IsSlow(duration time.Duration) bool {
+	return j.slowThreshold > 0 && duration > j.slowThreshold
+}
+
+func (j *QueryJournal) run() {
+	for r := range j.records {
+		j.writeToDisk(r)
+		if j.mongoSink != nil {
+			if err := j.mongoSink.Insert(r); err != nil {
+				log.Println("journal mongo sink error:", err)
+			}
+		}
+	}
+}
+
+func (j *QueryJournal) writeToDisk(r JournalRecord) {
+	data, err := json.Marshal(r)
+	if err != nil {
+		log.Println("journal marshal error:", err)
+		return
+	}
+	data = append(data, '\n')
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if j.curFile == nil || j.curSize+int64(len(data)) > j.maxFileSize {
+		if err := j.rotate(); err != nil {
+			log.Println("journal rotate error:", err)
+			return
+		}
+	}
+
+	n, err := j.curFile.Write(data)
+	if err != nil {
+		log.Println("journal write error:", err)
+		return
+	}
+	j.curSize += int64(n)
+}
+
+// rotate closes the current file (if any), opens a fresh one and evicts
+// the oldest files over maxFiles. Caller must hold j.mu.
+func (j *QueryJournal) rotate() error {
+	if j.curFile != nil {
+		j.curFile.Close()
+	}
+
+	name := filepath.Join(j.dir, fmt.Sprintf("queryguard-journal-%d.ndjson", time.Now().UnixNano()))
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+
+	j.curFile = f
+	j.curSize = 0
+
+	return j.evictOldest()
+}
+
+func (j *QueryJournal) evictOldest() error {
+	entries, err := filepath.Glob(filepath.Join(j.dir, "queryguard-journal-*.ndjson"))
+	if err != nil {
+		return err
+	}
+	if len(entries) <= j.maxFiles {
+		return nil
+	}
+
+	sort.Strings(entries)
+	for _, old := range entries[:len(entries)-j.maxFiles] {
+		if err := os.Remove(old); err != nil {
+			log.Println("journal evict error:", err)
+		}
+	}
+
+	return nil
+}
+
+// bsonDocToMap converts a bson.D (and any nested bson.D/array values) into
+// plain map[string]interface{}/[]interface{} so it marshals to sane JSON.
+func bsonDocToMap(d bson.D) map[string]interface{} {
+	m := make(map[string]interface{}, len(d))
+	for _, e := range d {
+		m[e.Name] = bsonValueToInterface(e.Value)
+	}
+	return m
+}
+
+func bsonValueToInterface(v interface{}) interface{} {
+	switch t := v.(type) {
+	case bson.D:
+		return bsonDocToMap(t)
+	case []interface{}:
+		out := make([]interface{}, len(t))
+		for i, e := range t {
+			out[i] = bsonValueToInterface(e)
+		}
+		return out
+	default:
+		return t
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ *   Queryguard - Simple 1:1 proxy for mongodb that prevents people from running queries that won't use indexes
+ *   Copyright (c) 2016 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	queriesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "queryguard",
+		Name:      "queries_total",
+		Help:      "Queries seen by the proxy, labeled by database, collection and decision.",
+	}, []string{"database", "collection", "decision", "reason"})
+
+	queriesKilled = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "queryguard",
+		Name:      "queries_killed_total",
+		Help:      "Queries killed via the backchannel killop path, labeled by database and collection.",
+	}, []string{"database", "collection"})
+
+	upstreamDialFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "queryguard",
+		Name:      "upstream_dial_failures_total",
+		Help:      "Failed TCP dials to an upstream mongod/mongos, labeled by server.",
+	}, []string{"server"})
+
+	queryDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "queryguard",
+		Name:      "query_duration_seconds",
+		Help:      "Round-trip time between forwarding a query and relaying its reply.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"database", "collection"})
+
+	clientConnections = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: "queryguard",
+		Name:      "client_connections",
+		Help:      "Currently open client connections.",
+	})
+
+	bsonParseErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "queryguard",
+		Name:      "bson_parse_errors_total",
+		Help:      "BSON documents that failed to parse while inspecting a query.",
+	})
+
+	journalRecordsDropped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: "queryguard",
+		Name:      "journal_records_dropped_total",
+		Help:      "Query journal records dropped because the in-memory ring buffer was full.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		queriesTotal,
+		queriesKilled,
+		upstreamDialFailures,
+		queryDuration,
+		clientConnections,
+		bsonParseErrors,
+		journalRecordsDropped,
+	)
+}
+
+// ServeMetrics starts an HTTP server exposing Prometheus metrics at
+// /metrics on listen. It blocks, so callers should run it in its own
+// goroutine.
+func ServeMetrics(listen string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return http.ListenAndServe(listen, mux)
+}
@@ -0,0 +1,510 @@
+/*
+ *   Queryguard - Simple 1:1 proxy for mongodb that prevents people from running queries that won't use indexes
+ *   Copyright (c) 2016 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+
+	"github.com/NorgannasAddOns/go-uuid"
+	"github.com/davecgh/go-spew/spew"
+)
+
+// OpMsg is the opcode MongoDB 3.6+ drivers use for everything - queries,
+// writes and admin commands alike - in place of the legacy OpQuery/OpReply
+// pair.
+const OpMsg OpCode = 2013
+
+const (
+	opMsgFlagChecksumPresent uint32 = 1 << 0
+	opMsgFlagMoreToCome      uint32 = 1 << 1
+	opMsgFlagExhaustAllowed  uint32 = 1 << 16
+
+	opMsgSectionKindBody        byte = 0
+	opMsgSectionKindDocSequence byte = 1
+)
+
+// opMsgCommandCollections lists the commands extractOpMsgQuery recognizes,
+// keyed on the command name. For all but getMore the command's value is the
+// target collection name; getMore's value is a cursor id and it carries no
+// filter, so extractOpMsgQuery never index-checks it.
+var opMsgCommandCollections = map[string]bool{
+	"find":      true,
+	"getMore":   true,
+	"aggregate": true,
+	"count":     true,
+	"distinct":  true,
+	"update":    true,
+	"delete":    true,
+}
+
+// opMsgSection is a single decoded section of an OP_MSG body: a kind 0
+// section carries exactly one document, a kind 1 section carries an
+// identifier (e.g. "updates") plus a run of documents.
+type opMsgSection struct {
+	kind       byte
+	identifier string
+	docs       []bson.D
+}
+
+func (p *Proxy) handleOpMsgRequest(h *messageHeader, client, server io.ReadWriter) error {
+	remoteAddr := "unknown"
+	if c, ok := client.(net.Conn); ok {
+		remoteAddr = c.RemoteAddr().String()
+	}
+
+	body := make([]byte, h.MessageLength-headerLen)
+	if _, err := io.ReadFull(client, body); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	flagBits, payload, err := splitOpMsgBody(body)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	sections, err := parseOpMsgSections(payload)
+	if err != nil {
+		log.Println("OP_MSG parse error, forwarding blind:", err)
+		return p.forwardOpMsg(h, body, client, server)
+	}
+
+	command, collection, database, filter, ok := p.extractOpMsgQuery(sections)
+	if !ok {
+		return p.forwardOpMsg(h, body, client, server)
+	}
+
+	log.Printf("[%s] Checking OP_MSG %s for %s.%s: %s", remoteAddr, command, database, collection, spew.Sdump(filter))
+	var sort bson.D
+	if s, isD := p.getKey(sections[0].docs[0], "sort").(bson.D); isD {
+		sort = s
+	}
+	hasHint := p.hasKey(sections[0].docs[0], "hint")
+	if !p.checkForIndex(database, collection, filter, sort, hasHint) {
+		log.Printf("[%s] Rejecting query", remoteAddr)
+		queriesTotal.WithLabelValues(database, collection, "rejected", "no_index").Inc()
+		if p.journal != nil {
+			p.journal.Record(JournalRecord{
+				RemoteAddr: remoteAddr,
+				Database:   database,
+				Collection: collection,
+				Query:      bsonDocToMap(filter),
+				Outcome:    JournalOutcomeRejected,
+			})
+		}
+		return p.sendOpMsgErrorToClient(h, client, fmt.Errorf("No index was found that could be used for your query try db.%s.getIndexes()", collection), 17357)
+	}
+	queriesTotal.WithLabelValues(database, collection, "accepted", "").Inc()
+
+	queryID := uuid.New("Q")
+	sections[0].docs[0] = p.mutateOpMsgCommand(sections[0].docs[0], remoteAddr, queryID)
+
+	newBody, err := rebuildOpMsgBody(flagBits, sections)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	withChecksum := flagBits&opMsgFlagChecksumPresent != 0
+	msgLen := headerLen + len(newBody)
+	if withChecksum {
+		msgLen += 4
+	}
+	h.MessageLength = int32(msgLen)
+	headerBytes := h.ToWire()
+
+	if withChecksum {
+		newBody = appendOpMsgChecksum(headerBytes, newBody)
+	}
+
+	if _, err := server.Write(headerBytes); err != nil {
+		log.Println(err)
+		return err
+	}
+	if _, err := server.Write(newBody); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return p.relayOpMsgReply(flagBits, client, server)
+}
+
+// forwardOpMsg relays an already-read OP_MSG body upstream untouched, for
+// commands we don't (yet) know how to index-check.
+func (p *Proxy) forwardOpMsg(h *messageHeader, body []byte, client, server io.ReadWriter) error {
+	if _, err := server.Write(h.ToWire()); err != nil {
+		log.Println(err)
+		return err
+	}
+	if _, err := server.Write(body); err != nil {
+		log.Println(err)
+		return err
+	}
+
+	flagBits, _, err := splitOpMsgBody(body)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+
+	return p.relayOpMsgReply(flagBits, client, server)
+}
+
+// relayOpMsgReply relays the upstream reply to an OP_MSG request, unless
+// the request's flagBits had moreToCome set - meaning it was a fire-and-
+// forget write the server never replies to. When the request had
+// exhaustAllowed set, the server may stream multiple replies without a
+// further request; keep draining them (relaying each) while a reply's own
+// moreToCome bit is set.
+func (p *Proxy) relayOpMsgReply(requestFlagBits uint32, client, server io.ReadWriter) error {
+	if requestFlagBits&opMsgFlagMoreToCome != 0 {
+		return nil
+	}
+
+	for {
+		replyHeader, err := readHeader(server)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+
+		replyBody := make([]byte, replyHeader.MessageLength-headerLen)
+		if _, err := io.ReadFull(server, replyBody); err != nil {
+			log.Println(err)
+			return err
+		}
+
+		if _, err := client.Write(replyHeader.ToWire()); err != nil {
+			log.Println(err)
+			return err
+		}
+		if _, err := client.Write(replyBody); err != nil {
+			log.Println(err)
+			return err
+		}
+
+		if len(replyBody) < 4 {
+			return nil
+		}
+		replyFlagBits := binary.LittleEndian.Uint32(replyBody[0:4])
+		if replyFlagBits&opMsgFlagMoreToCome == 0 {
+			return nil
+		}
+	}
+}
+
+// splitOpMsgBody pulls the flagBits out of an OP_MSG body (everything
+// after the standard header) and returns the section payload with any
+// trailing checksum stripped.
+func splitOpMsgBody(body []byte) (flagBits uint32, payload []byte, err error) {
+	if len(body) < 4 {
+		return 0, nil, fmt.Errorf("OP_MSG body too short to hold flagBits: %d bytes", len(body))
+	}
+
+	flagBits = binary.LittleEndian.Uint32(body[0:4])
+	payload = body[4:]
+
+	if flagBits&opMsgFlagChecksumPresent != 0 {
+		if len(payload) < 4 {
+			return 0, nil, fmt.Errorf("OP_MSG body too short to hold its checksum: %d bytes", len(payload))
+		}
+		payload = payload[:len(payload)-4]
+	}
+
+	return flagBits, payload, nil
+}
+
+// appendOpMsgChecksum computes the CRC32C checksum MongoDB's OP_MSG
+// checksum covers the standard header plus the message body, so it must
+// be computed after MessageLength (and therefore headerBytes) is final.
+func appendOpMsgChecksum(headerBytes, body []byte) []byte {
+	var checksumInput bytes.Buffer
+	checksumInput.Write(headerBytes)
+	checksumInput.Write(body)
+
+	checksum := crc32.Checksum(checksumInput.Bytes(), crc32.MakeTable(crc32.Castagnoli))
+	var checksumBytes [4]byte
+	binary.LittleEndian.PutUint32(checksumBytes[:], checksum)
+
+	return append(body, checksumBytes[:]...)
+}
+
+func parseOpMsgSections(payload []byte) ([]opMsgSection, error) {
+	var sections []opMsgSection
+	for len(payload) > 0 {
+		kind := payload[0]
+		payload = payload[1:]
+
+		switch kind {
+		case opMsgSectionKindBody:
+			doc, rest, err := readBsonDocFromBytes(payload)
+			if err != nil {
+				return nil, err
+			}
+			var d bson.D
+			if err := bson.Unmarshal(doc, &d); err != nil {
+				bsonParseErrors.Inc()
+				return nil, err
+			}
+			sections = append(sections, opMsgSection{kind: kind, docs: []bson.D{d}})
+			payload = rest
+
+		case opMsgSectionKindDocSequence:
+			if len(payload) < 4 {
+				return nil, fmt.Errorf("short OP_MSG section 1")
+			}
+			size := int(int32(binary.LittleEndian.Uint32(payload[0:4])))
+			if size < 4 || size > len(payload) {
+				return nil, fmt.Errorf("invalid OP_MSG section 1 size %d", size)
+			}
+			section := payload[4:size]
+			idEnd := bytes.IndexByte(section, 0)
+			if idEnd < 0 {
+				return nil, fmt.Errorf("unterminated OP_MSG section 1 identifier")
+			}
+			identifier := string(section[:idEnd])
+			rest := section[idEnd+1:]
+
+			var docs []bson.D
+			for len(rest) > 0 {
+				doc, r, err := readBsonDocFromBytes(rest)
+				if err != nil {
+					return nil, err
+				}
+				var d bson.D
+				if err := bson.Unmarshal(doc, &d); err != nil {
+					bsonParseErrors.Inc()
+					return nil, err
+				}
+				docs = append(docs, d)
+				rest = r
+			}
+
+			sections = append(sections, opMsgSection{kind: kind, identifier: identifier, docs: docs})
+			payload = payload[size:]
+
+		default:
+			return nil, fmt.Errorf("unknown OP_MSG section kind %d", kind)
+		}
+	}
+
+	return sections, nil
+}
+
+func readBsonDocFromBytes(b []byte) (doc, rest []byte, err error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("short BSON document")
+	}
+	size := int(int32(binary.LittleEndian.Uint32(b[0:4])))
+	if size < 4 || size > len(b) {
+		return nil, nil, fmt.Errorf("invalid BSON document size %d", size)
+	}
+	return b[0:size], b[size:], nil
+}
+
+// extractOpMsgQuery pulls the command name, target collection, database and
+// indexable filter out of a decoded OP_MSG, matching the same filter/query/q
+// and pipeline $match conventions checkForIndex already understands for
+// OpQuery. ok is false when the command isn't one we index-check, or when it
+// carries no filter we can look at (e.g. getMore).
+func (p *Proxy) extractOpMsgQuery(sections []opMsgSection) (command, collection, database string, filter bson.D, ok bool) {
+	if len(sections) == 0 || len(sections[0].docs) == 0 || len(sections[0].docs[0]) == 0 {
+		return "", "", "", nil, false
+	}
+
+	body := sections[0].docs[0]
+	command = body[0].Name
+	if !opMsgCommandCollections[command] {
+		return "", "", "", nil, false
+	}
+
+	collection, _ = body[0].Value.(string)
+	database, _ = p.getKey(body, "db").(string)
+	if collection == "" || database == "" {
+		return "", "", "", nil, false
+	}
+
+	switch command {
+	case "find", "count", "distinct":
+		if f, isD := p.getKey(body, "filter").(bson.D); isD {
+			return command, collection, database, f, true
+		}
+		if f, isD := p.getKey(body, "query").(bson.D); isD {
+			return command, collection, database, f, true
+		}
+
+	case "aggregate":
+		if pipeline, isSlice := p.getKey(body, "pipeline").([]interface{}); isSlice {
+			for _, stage := range pipeline {
+				if sd, isD := stage.(bson.D); isD {
+					if f, isD2 := p.getKey(sd, "$match").(bson.D); isD2 {
+						return command, collection, database, f, true
+					}
+				}
+			}
+		}
+
+	case "update", "delete":
+		arrKey := "updates"
+		if command == "delete" {
+			arrKey = "deletes"
+		}
+		for _, sec := range sections {
+			if sec.kind != opMsgSectionKindDocSequence || sec.identifier != arrKey {
+				continue
+			}
+			for _, d := range sec.docs {
+				if f, isD := p.getKey(d, "q").(bson.D); isD {
+					return command, collection, database, f, true
+				}
+			}
+		}
+	}
+
+	return command, collection, database, nil, false
+}
+
+// mutateOpMsgCommand tags an accepted command body the same way mutateQuery
+// tags an OpQuery: a clamped maxTimeMS, plus tracking data so the command
+// can be found in currentOp/the profiler later. Unlike the legacy OpQuery
+// path, this rides in the "comment" field rather than a $queryGuard
+// sibling - modern mongod/mongos command parsers reject unrecognized
+// $-prefixed top-level arguments, while "comment" is accepted on every
+// CRUD command and surfaces verbatim in currentOp(). Note this means the
+// OP_MSG kill path can't reuse handleQueryRequest's
+// query.$queryGuard.track lookup: OP_MSG ops show up in currentOp() under
+// "command", not "query", so killing them needs its own comment-based
+// lookup if that's ever added.
+func (p *Proxy) mutateOpMsgCommand(body bson.D, remoteAddr, queryID string) bson.D {
+	maxTimeMS := float64((p.messageTimeout - 1*time.Second) / time.Millisecond)
+	if index := p.keyIndex(body, "maxTimeMS"); index >= 0 {
+		var v float64
+		switch t := body[index].Value.(type) {
+		case float64:
+			v = t
+		case int:
+			v = float64(t)
+		case int64:
+			v = float64(t)
+		}
+		if v > maxTimeMS {
+			body[index].Value = maxTimeMS
+		}
+	} else {
+		body = append(body, bson.DocElem{Name: "maxTimeMS", Value: maxTimeMS})
+	}
+
+	comment := fmt.Sprintf("queryguard track=%s remoteaddr=%s", queryID, remoteAddr)
+	if index := p.keyIndex(body, "comment"); index >= 0 {
+		body[index].Value = comment
+	} else {
+		body = append(body, bson.DocElem{Name: "comment", Value: comment})
+	}
+
+	return body
+}
+
+// rebuildOpMsgBody re-serializes the OP_MSG sections after mutation.
+// The caller is responsible for appending the trailing CRC32C checksum
+// (via appendOpMsgChecksum) once the enclosing message header is final,
+// since the checksum covers the header too.
+func rebuildOpMsgBody(flagBits uint32, sections []opMsgSection) ([]byte, error) {
+	var buf bytes.Buffer
+
+	var flagsBytes [4]byte
+	binary.LittleEndian.PutUint32(flagsBytes[:], flagBits)
+	buf.Write(flagsBytes[:])
+
+	for _, sec := range sections {
+		buf.WriteByte(sec.kind)
+
+		switch sec.kind {
+		case opMsgSectionKindBody:
+			doc, err := bson.Marshal(sec.docs[0])
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(doc)
+
+		case opMsgSectionKindDocSequence:
+			var inner bytes.Buffer
+			inner.WriteString(sec.identifier)
+			inner.WriteByte(0)
+			for _, d := range sec.docs {
+				doc, err := bson.Marshal(d)
+				if err != nil {
+					return nil, err
+				}
+				inner.Write(doc)
+			}
+
+			var sizeBytes [4]byte
+			binary.LittleEndian.PutUint32(sizeBytes[:], uint32(4+inner.Len()))
+			buf.Write(sizeBytes[:])
+			buf.Write(inner.Bytes())
+		}
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (p *Proxy) sendOpMsgErrorToClient(h *messageHeader, client io.Writer, err error, code int) error {
+	errorDoc, merr := bson.Marshal(bson.D{
+		bson.DocElem{Name: "ok", Value: float64(0)},
+		bson.DocElem{Name: "errmsg", Value: err.Error()},
+		bson.DocElem{Name: "code", Value: code},
+	})
+	if merr != nil {
+		return merr
+	}
+
+	var msgBody bytes.Buffer
+	var flags [4]byte
+	msgBody.Write(flags[:])
+	msgBody.WriteByte(opMsgSectionKindBody)
+	msgBody.Write(errorDoc)
+
+	replyHeader := &messageHeader{
+		MessageLength: int32(headerLen + msgBody.Len()),
+		RequestID:     h.RequestID,
+		ResponseTo:    h.RequestID,
+		OpCode:        OpMsg,
+	}
+
+	if _, err := client.Write(replyHeader.ToWire()); err != nil {
+		return err
+	}
+	if _, err := client.Write(msgBody.Bytes()); err != nil {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,150 @@
+/*
+ *   Queryguard - Simple 1:1 proxy for mongodb that prevents people from running queries that won't use indexes
+ *   Copyright (c) 2016 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func mustMarshal(t *testing.T, d bson.D) []byte {
+	t.Helper()
+	doc, err := bson.Marshal(d)
+	if err != nil {
+		t.Fatalf("marshalling test document: %s", err)
+	}
+	return doc
+}
+
+func TestParseOpMsgSectionsValidBody(t *testing.T) {
+	doc := mustMarshal(t, bson.D{{Name: "find", Value: "widgets"}})
+
+	sections, err := parseOpMsgSections(append([]byte{opMsgSectionKindBody}, doc...))
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if len(sections) != 1 || sections[0].kind != opMsgSectionKindBody {
+		t.Fatalf("got %+v", sections)
+	}
+	if len(sections[0].docs) != 1 || sections[0].docs[0][0].Name != "find" {
+		t.Fatalf("got docs %+v", sections[0].docs)
+	}
+}
+
+func TestParseOpMsgSectionsTruncatedKind0Doc(t *testing.T) {
+	doc := mustMarshal(t, bson.D{{Name: "find", Value: "widgets"}})
+	payload := append([]byte{opMsgSectionKindBody}, doc[:len(doc)-3]...)
+
+	if _, err := parseOpMsgSections(payload); err == nil {
+		t.Fatal("expected an error for a truncated kind 0 document")
+	}
+}
+
+func TestParseOpMsgSectionsMalformedKind1Size(t *testing.T) {
+	payload := []byte{opMsgSectionKindDocSequence, 0xFF, 0xFF, 0xFF, 0x7F}
+
+	if _, err := parseOpMsgSections(payload); err == nil {
+		t.Fatal("expected an error for an oversized kind 1 section length")
+	}
+}
+
+func TestParseOpMsgSectionsShortKind1Header(t *testing.T) {
+	payload := []byte{opMsgSectionKindDocSequence, 0x01}
+
+	if _, err := parseOpMsgSections(payload); err == nil {
+		t.Fatal("expected an error for a truncated kind 1 section length")
+	}
+}
+
+func TestParseOpMsgSectionsUnknownKind(t *testing.T) {
+	if _, err := parseOpMsgSections([]byte{0x42}); err == nil {
+		t.Fatal("expected an error for an unknown section kind")
+	}
+}
+
+func TestSplitOpMsgBodyTooShortForFlags(t *testing.T) {
+	if _, _, err := splitOpMsgBody([]byte{0x01, 0x02}); err == nil {
+		t.Fatal("expected an error for a body too short to hold flagBits")
+	}
+}
+
+func TestSplitOpMsgBodyTooShortForChecksum(t *testing.T) {
+	body := make([]byte, 4)
+	binary.LittleEndian.PutUint32(body, opMsgFlagChecksumPresent)
+
+	if _, _, err := splitOpMsgBody(body); err == nil {
+		t.Fatal("expected an error when checksumPresent is set but no checksum bytes follow")
+	}
+}
+
+func TestExtractOpMsgQueryFindExtractsDbCollectionFilter(t *testing.T) {
+	p := &Proxy{}
+	body := bson.D{
+		{Name: "find", Value: "widgets"},
+		{Name: "filter", Value: bson.D{{Name: "sku", Value: "abc"}}},
+		{Name: "$db", Value: "shop"},
+	}
+	sections := []opMsgSection{{kind: opMsgSectionKindBody, docs: []bson.D{body}}}
+
+	command, collection, database, filter, ok := p.extractOpMsgQuery(sections)
+	if !ok {
+		t.Fatal("expected extractOpMsgQuery to recognize a find command")
+	}
+	if command != "find" || collection != "widgets" || database != "shop" {
+		t.Fatalf("got command=%q collection=%q database=%q", command, collection, database)
+	}
+	if len(filter) != 1 || filter[0].Name != "sku" || filter[0].Value != "abc" {
+		t.Fatalf("got filter %+v", filter)
+	}
+}
+
+func TestExtractOpMsgQueryMissingDbFails(t *testing.T) {
+	p := &Proxy{}
+	body := bson.D{
+		{Name: "find", Value: "widgets"},
+		{Name: "filter", Value: bson.D{{Name: "sku", Value: "abc"}}},
+	}
+	sections := []opMsgSection{{kind: opMsgSectionKindBody, docs: []bson.D{body}}}
+
+	if _, _, _, _, ok := p.extractOpMsgQuery(sections); ok {
+		t.Fatal("expected extractOpMsgQuery to fail without a $db field")
+	}
+}
+
+func TestSplitOpMsgBodyStripsChecksum(t *testing.T) {
+	body := make([]byte, 4)
+	binary.LittleEndian.PutUint32(body, opMsgFlagChecksumPresent)
+	body = append(body, opMsgSectionKindBody)
+	body = append(body, 0, 0, 0, 0) // fake checksum
+
+	flagBits, payload, err := splitOpMsgBody(body)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if flagBits != opMsgFlagChecksumPresent {
+		t.Fatalf("got flagBits %d", flagBits)
+	}
+	if len(payload) != 1 || payload[0] != opMsgSectionKindBody {
+		t.Fatalf("got payload %v", payload)
+	}
+}
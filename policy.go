@@ -0,0 +1,349 @@
+/*
+ *   Queryguard - Simple 1:1 proxy for mongodb that prevents people from running queries that won't use indexes
+ *   Copyright (c) 2016 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+	"gopkg.in/yaml.v2"
+)
+
+// Policy decides whether a query against a collection may proceed, given
+// that collection's indexes and approximate document count. It replaces
+// the old hard-coded "first field must be indexed" rule in checkForIndex,
+// so different index-check strategies (or per-collection overrides) can be
+// swapped in without touching the wire protocol handlers.
+type Policy interface {
+	// Check returns ok=false when the query should be rejected, along with
+	// a short machine-friendly reason, which checkForIndex logs; the
+	// queries_total metric records every rejection as "no_index". hasHint
+	// tells Check about a hint the caller found outside query itself (the
+	// OP_MSG command's sibling "hint" field); a legacy OpQuery's sibling
+	// $hint is detected from query directly.
+	Check(database, collection string, query, sort bson.D, hasHint bool, indexes []mgo.Index, count int64) (ok bool, reason string)
+}
+
+// CollectionRule is the per-collection override a PolicyConfig can load
+// from YAML or JSON, keyed on "database.collection".
+type CollectionRule struct {
+	RequireIndex    bool     `yaml:"require_index" json:"require_index"`
+	AllowScanUnder  int64    `yaml:"allow_scan_under" json:"allow_scan_under"`
+	DeniedOperators []string `yaml:"denied_operators" json:"denied_operators"`
+}
+
+// PolicyConfig is the on-disk shape of policy.yaml/policy.json.
+type PolicyConfig struct {
+	Collections map[string]CollectionRule `yaml:"collections" json:"collections"`
+}
+
+func (c *PolicyConfig) rule(database, collection string) CollectionRule {
+	if c == nil || c.Collections == nil {
+		return CollectionRule{}
+	}
+	return c.Collections[database+"."+collection]
+}
+
+// LoadPolicyConfig reads a YAML or JSON policy config, chosen by the file
+// extension of path.
+func LoadPolicyConfig(path string) (*PolicyConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &PolicyConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		if err := yaml.Unmarshal(data, config); err != nil {
+			return nil, err
+		}
+	case ".json":
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported policy config extension %q", filepath.Ext(path))
+	}
+
+	return config, nil
+}
+
+// defaultPolicy is the stock Policy: it requires an index whose leading key
+// is one of the fields the predicate touches - each $or/$nor branch checked
+// independently, since MongoDB plans them as separate sub-queries - and
+// honours $hint and the per-collection config rules.
+type defaultPolicy struct {
+	config *PolicyConfig
+}
+
+// NewDefaultPolicy builds the stock Policy. config may be nil, in which
+// case every collection behaves as if it had no override rule.
+func NewDefaultPolicy(config *PolicyConfig) *defaultPolicy {
+	if config == nil {
+		config = &PolicyConfig{}
+	}
+	return &defaultPolicy{config: config}
+}
+
+func (dp *defaultPolicy) Check(database, collection string, query, sort bson.D, hasHint bool, indexes []mgo.Index, count int64) (bool, string) {
+	rule := dp.config.rule(database, collection)
+
+	// $hint is a sibling of the predicate, not part of it, so it has to be
+	// looked for on the raw query before unwrapQueryWrapper discards the
+	// wrapper that carries it (and, for OP_MSG, the caller ORs in the
+	// command-level hint field here since it never reaches query at all).
+	hasHint = hasHint || hasKey(query, "$hint")
+	query = unwrapQueryWrapper(query)
+
+	if op := findDeniedOperator(query, rule.DeniedOperators); op != "" {
+		return false, "denied_operator:" + op
+	}
+
+	if rule.AllowScanUnder > 0 && count < rule.AllowScanUnder {
+		return true, ""
+	}
+	// No point index checking an empty collection - it may not even exist.
+	if count == 0 {
+		return true, ""
+	}
+
+	if hasHint {
+		return true, ""
+	}
+
+	hasPredicate, covered := queryIndexCovered(query, indexes)
+	if !hasPredicate {
+		if rule.RequireIndex {
+			return false, "no_predicate"
+		}
+		return true, ""
+	}
+	if !covered {
+		return false, "no_index"
+	}
+
+	if len(sort) > 0 {
+		if _, sortCovered := queryIndexCovered(query, indexesCoveringSort(indexes, sort)); !sortCovered {
+			return false, "no_index"
+		}
+	}
+
+	return true, ""
+}
+
+// unwrapQueryWrapper pulls the predicate out of the legacy OpQuery
+// meta-wrapper - {$query:{...},$orderby:{...}} or its unprefixed
+// {query:{...},orderby:{...}} form - so callers see the actual predicate
+// rather than a document made entirely of meta-operator keys. Mirrors the
+// unwrap firstIndexableField did before Policy replaced it.
+func unwrapQueryWrapper(query bson.D) bson.D {
+	if len(query) > 1 && strings.TrimLeft(query[0].Name, "$") == "query" {
+		if q, isD := query[0].Value.(bson.D); isD {
+			return q
+		}
+	}
+	return query
+}
+
+// queryIndexCovered reports whether query has a predicate at all
+// (hasPredicate) and, if so, whether some index in indexes can be used to
+// satisfy it (covered). $or/$nor are rewritten by MongoDB's planner into
+// one sub-query per branch, each of which needs its own covering index
+// (combined with whatever fields sit outside the $or/$nor at this level,
+// since those apply to every branch) - so unlike a plain $and, merging
+// every branch's fields into a single set and checking that isn't enough:
+// a branch with no covering index still forces a collection scan for the
+// documents it matches, even if some other branch is indexed.
+func queryIndexCovered(query bson.D, indexes []mgo.Index) (hasPredicate, covered bool) {
+	ownFields := make(map[string]bool)
+	var branches [][]interface{}
+	for _, e := range query {
+		switch strings.ToLower(e.Name) {
+		case "$or", "$nor":
+			if b, ok := e.Value.([]interface{}); ok {
+				branches = append(branches, b)
+			}
+		default:
+			collectPredicateFieldsInto(bson.D{e}, ownFields)
+		}
+	}
+
+	hasPredicate = len(ownFields) > 0 || len(branches) > 0
+	if !hasPredicate {
+		return false, false
+	}
+
+	if len(branches) == 0 {
+		return true, indexCoversFields(ownFields, indexes)
+	}
+
+	for _, branch := range branches {
+		for _, b := range branch {
+			sub, ok := b.(bson.D)
+			if !ok {
+				continue
+			}
+			branchFields := make(map[string]bool, len(ownFields))
+			for f := range ownFields {
+				branchFields[f] = true
+			}
+			collectPredicateFieldsInto(sub, branchFields)
+			if !indexCoversFields(branchFields, indexes) {
+				return true, false
+			}
+		}
+	}
+
+	return true, true
+}
+
+func indexCoversFields(fields map[string]bool, indexes []mgo.Index) bool {
+	for _, index := range indexes {
+		if indexPrefixCovered(index, fields) {
+			return true
+		}
+	}
+	return false
+}
+
+// indexesCoveringSort returns the indexes that cover every field of sort.
+func indexesCoveringSort(indexes []mgo.Index, sort bson.D) []mgo.Index {
+	var out []mgo.Index
+	for _, index := range indexes {
+		if indexCoversSort(index, sort) {
+			out = append(out, index)
+		}
+	}
+	return out
+}
+
+// collectPredicateFieldsInto walks a query document (not recursing into
+// $or/$nor, whose branches queryIndexCovered handles separately) and adds
+// the fields its predicate touches to fields, recursing into $and and
+// ignoring meta-operators ($where, $comment, $hint, $text) that aren't
+// themselves indexable fields.
+func collectPredicateFieldsInto(query bson.D, fields map[string]bool) {
+	for _, e := range query {
+		switch strings.ToLower(e.Name) {
+		case "$and":
+			branches, ok := e.Value.([]interface{})
+			if !ok {
+				continue
+			}
+			for _, branch := range branches {
+				if sub, ok := branch.(bson.D); ok {
+					collectPredicateFieldsInto(sub, fields)
+				}
+			}
+		case "$or", "$nor":
+			// Handled by queryIndexCovered, which checks each branch's own
+			// coverage rather than folding them into one field set.
+		case "$where", "$comment", "$hint", "$text", "$query", "$orderby", "$maxtimems", "$queryguard":
+			// Not predicate fields.
+		default:
+			if strings.HasPrefix(e.Name, "$") {
+				continue
+			}
+			fields[e.Name] = true
+		}
+	}
+}
+
+// indexPrefixCovered reports whether at least the leading key of index is
+// present in fields, following the usual compound-index-prefix rule: an
+// index can be used once its leading keys are all covered, even if later
+// keys in the index aren't part of the predicate.
+func indexPrefixCovered(index mgo.Index, fields map[string]bool) bool {
+	covered := 0
+	for _, key := range index.Key {
+		if !fields[strings.TrimPrefix(key, "-")] {
+			break
+		}
+		covered++
+	}
+	return covered > 0
+}
+
+// indexCoversSort reports whether every field the query sorts on also
+// appears somewhere in index's keys, matching MongoDB's own planner
+// constraint that a sort must be satisfiable by the index used for the
+// predicate.
+func indexCoversSort(index mgo.Index, sort bson.D) bool {
+	indexFields := make(map[string]bool, len(index.Key))
+	for _, key := range index.Key {
+		indexFields[strings.TrimPrefix(key, "-")] = true
+	}
+	for _, s := range sort {
+		if !indexFields[s.Name] {
+			return false
+		}
+	}
+	return true
+}
+
+func hasKey(d bson.D, k string) bool {
+	for _, e := range d {
+		if strings.EqualFold(e.Name, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func findDeniedOperator(query bson.D, denied []string) string {
+	if len(denied) == 0 {
+		return ""
+	}
+	deniedSet := make(map[string]bool, len(denied))
+	for _, op := range denied {
+		deniedSet[op] = true
+	}
+	return findOperator(query, deniedSet)
+}
+
+func findOperator(d bson.D, denied map[string]bool) string {
+	for _, e := range d {
+		if denied[e.Name] {
+			return e.Name
+		}
+		switch v := e.Value.(type) {
+		case bson.D:
+			if op := findOperator(v, denied); op != "" {
+				return op
+			}
+		case []interface{}:
+			for _, item := range v {
+				if sub, ok := item.(bson.D); ok {
+					if op := findOperator(sub, denied); op != "" {
+						return op
+					}
+				}
+			}
+		}
+	}
+	return ""
+}
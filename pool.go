@@ -0,0 +1,311 @@
+/*
+ *   Queryguard - Simple 1:1 proxy for mongodb that prevents people from running queries that won't use indexes
+ *   Copyright (c) 2016 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/mgo.v2"
+)
+
+// serverHealth tracks the dial/error history and in-flight count of a
+// single upstream server so the pool can route around one that's failing
+// without needing a client to notice.
+type serverHealth struct {
+	addr string
+
+	mu                sync.Mutex
+	consecutiveErrors int
+	lastFailure       time.Time
+	coolingDown       bool
+
+	inFlight int32
+}
+
+// pooledConn is a net.Conn checked out of a ServerPool; it remembers which
+// server it came from so Put can report health and check it back in.
+type pooledConn struct {
+	net.Conn
+	server *serverHealth
+}
+
+// ServerPool maintains a small warm set of connections per upstream
+// server, tracks per-server health, and picks servers by power-of-two
+// choices on least in-flight count.
+type ServerPool struct {
+	dialTimeout time.Duration
+	warmSize    int
+	maxErrors   int
+	coolDown    time.Duration
+
+	pingUser, pingPass, pingAuthdb string
+
+	mu       sync.Mutex
+	servers  []*serverHealth
+	idle     map[string][]net.Conn
+	draining bool
+	wg       sync.WaitGroup
+}
+
+// NewServerPool builds a pool over servers. warmSize bounds how many idle
+// connections are kept per server; maxErrors consecutive dial failures
+// take a server out of rotation for coolDown, after which it's probed back
+// in on a background goroutine that dials that specific server directly
+// (authenticating first, if SetPingCredentials was called).
+func NewServerPool(servers []string, warmSize, maxErrors int, coolDown, dialTimeout time.Duration) *ServerPool {
+	sp := &ServerPool{
+		dialTimeout: dialTimeout,
+		warmSize:    warmSize,
+		maxErrors:   maxErrors,
+		coolDown:    coolDown,
+		idle:        make(map[string][]net.Conn),
+	}
+	for _, addr := range servers {
+		sp.servers = append(sp.servers, &serverHealth{addr: addr})
+	}
+	return sp
+}
+
+// SetPingCredentials lets the pool authenticate when it probes a
+// cooled-down server directly, instead of a bare TCP dial that can't tell
+// a listening-but-unauthenticated mongod from a healthy one.
+func (sp *ServerPool) SetPingCredentials(user, pass, authdb string) {
+	sp.pingUser = user
+	sp.pingPass = pass
+	sp.pingAuthdb = authdb
+}
+
+// Get checks out a connection to a healthy upstream server, reusing a warm
+// one if available.
+func (sp *ServerPool) Get() (net.Conn, error) {
+	server := sp.pickServer()
+	if server == nil {
+		return nil, fmt.Errorf("no healthy upstream servers available")
+	}
+
+	sp.mu.Lock()
+	if sp.draining {
+		sp.mu.Unlock()
+		return nil, fmt.Errorf("server pool is draining")
+	}
+	if conns := sp.idle[server.addr]; len(conns) > 0 {
+		c := conns[len(conns)-1]
+		sp.idle[server.addr] = conns[:len(conns)-1]
+		sp.mu.Unlock()
+		sp.checkout(server)
+		return &pooledConn{Conn: c, server: server}, nil
+	}
+	sp.mu.Unlock()
+
+	c, err := net.DialTimeout("tcp", server.addr, sp.dialTimeout)
+	if err != nil {
+		sp.recordFailure(server)
+		return nil, err
+	}
+	sp.recordSuccess(server)
+	sp.checkout(server)
+
+	return &pooledConn{Conn: c, server: server}, nil
+}
+
+// Put checks a connection back in. When healthy and there's room, it's
+// kept warm for reuse; otherwise it's closed.
+func (sp *ServerPool) Put(c net.Conn, healthy bool) {
+	pc, ok := c.(*pooledConn)
+	if !ok {
+		c.Close()
+		return
+	}
+	sp.checkin(pc.server)
+
+	if !healthy {
+		pc.Conn.Close()
+		return
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	if sp.draining || len(sp.idle[pc.server.addr]) >= sp.warmSize {
+		pc.Conn.Close()
+		return
+	}
+	sp.idle[pc.server.addr] = append(sp.idle[pc.server.addr], pc.Conn)
+}
+
+// pickServer selects among non-cooling-down servers by power-of-two
+// choices on least in-flight count, falling back to the full server list
+// if every server is currently cooling down so the proxy still makes
+// progress (and hopefully discovers one has recovered).
+func (sp *ServerPool) pickServer() *serverHealth {
+	sp.mu.Lock()
+	all := sp.servers
+	sp.mu.Unlock()
+
+	if len(all) == 0 {
+		return nil
+	}
+
+	healthy := make([]*serverHealth, 0, len(all))
+	for _, s := range all {
+		s.mu.Lock()
+		cooling := s.coolingDown
+		s.mu.Unlock()
+		if !cooling {
+			healthy = append(healthy, s)
+		}
+	}
+	if len(healthy) == 0 {
+		healthy = all
+	}
+	if len(healthy) == 1 {
+		return healthy[0]
+	}
+
+	a := healthy[rand.Intn(len(healthy))]
+	b := healthy[rand.Intn(len(healthy))]
+	if atomic.LoadInt32(&a.inFlight) <= atomic.LoadInt32(&b.inFlight) {
+		return a
+	}
+	return b
+}
+
+func (sp *ServerPool) checkout(s *serverHealth) {
+	atomic.AddInt32(&s.inFlight, 1)
+	sp.wg.Add(1)
+}
+
+func (sp *ServerPool) checkin(s *serverHealth) {
+	atomic.AddInt32(&s.inFlight, -1)
+	sp.wg.Done()
+}
+
+func (sp *ServerPool) recordFailure(s *serverHealth) {
+	upstreamDialFailures.WithLabelValues(s.addr).Inc()
+
+	s.mu.Lock()
+	s.consecutiveErrors++
+	s.lastFailure = time.Now()
+	shouldCool := s.consecutiveErrors >= sp.maxErrors && !s.coolingDown
+	if shouldCool {
+		s.coolingDown = true
+	}
+	s.mu.Unlock()
+
+	if shouldCool {
+		log.Printf("Upstream %s failed %d times in a row, cooling down for %s", s.addr, s.consecutiveErrors, sp.coolDown)
+		go sp.probeUntilHealthy(s)
+	}
+}
+
+func (sp *ServerPool) recordSuccess(s *serverHealth) {
+	s.mu.Lock()
+	s.consecutiveErrors = 0
+	s.coolingDown = false
+	s.mu.Unlock()
+}
+
+// probeUntilHealthy polls a cooled-down server on an interval until it
+// answers a ping, then brings it back into rotation.
+func (sp *ServerPool) probeUntilHealthy(s *serverHealth) {
+	ticker := time.NewTicker(sp.coolDown)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sp.mu.Lock()
+		draining := sp.draining
+		sp.mu.Unlock()
+		if draining {
+			return
+		}
+
+		if sp.ping(s.addr) {
+			log.Printf("Upstream %s is healthy again", s.addr)
+			sp.recordSuccess(s)
+			return
+		}
+	}
+}
+
+// ping probes addr itself - not just any member of the cluster - so a
+// still-dead server isn't mistaken for healthy because some other server
+// answered. When ping credentials are set it authenticates a direct mgo
+// session against addr; otherwise it falls back to a bare TCP dial.
+func (sp *ServerPool) ping(addr string) bool {
+	if sp.pingUser != "" {
+		session, err := mgo.DialWithInfo(&mgo.DialInfo{
+			Addrs:    []string{addr},
+			Direct:   true,
+			Timeout:  sp.dialTimeout,
+			Username: sp.pingUser,
+			Password: sp.pingPass,
+			Source:   sp.pingAuthdb,
+		})
+		if err != nil {
+			return false
+		}
+		defer session.Close()
+		return session.Ping() == nil
+	}
+
+	c, err := net.DialTimeout("tcp", addr, sp.dialTimeout)
+	if err != nil {
+		return false
+	}
+	c.Close()
+	return true
+}
+
+// Drain marks the pool as shutting down, waits (up to timeout) for
+// checked-out connections to be returned, then closes every warm idle
+// connection. Intended to be called on SIGTERM so in-flight queries finish
+// before the process exits.
+func (sp *ServerPool) Drain(timeout time.Duration) {
+	sp.mu.Lock()
+	sp.draining = true
+	sp.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		sp.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Println("Server pool drain timed out with in-flight queries still outstanding")
+	}
+
+	sp.mu.Lock()
+	defer sp.mu.Unlock()
+	for addr, conns := range sp.idle {
+		for _, c := range conns {
+			c.Close()
+		}
+		delete(sp.idle, addr)
+	}
+}
@@ -27,7 +27,6 @@ import (
 	"io"
 	"log"
 	"math"
-	"math/rand"
 	"net"
 	"net/url"
 	"strings"
@@ -61,29 +60,81 @@ type Proxy struct {
 
 	clientIdleTimeout time.Duration
 	messageTimeout    time.Duration
+
+	proxyProtocolMode ProxyProtocolMode
+	metricsListen     string
+	journal           *QueryJournal
+
+	pool            *ServerPool
+	poolWarmSize    int
+	poolMaxErrors   int
+	poolCoolDown    time.Duration
+	poolDialTimeout time.Duration
+
+	policy Policy
+}
+
+// SetPolicy overrides the index-check policy. Call before ListenAndRelay;
+// defaults to NewDefaultPolicy(nil) otherwise.
+func (p *Proxy) SetPolicy(policy Policy) {
+	p.policy = policy
+}
+
+// SetJournal enables recording rejected, killed and slow queries to
+// journal. Call before ListenAndRelay; the journal is left nil (and
+// nothing is recorded) otherwise.
+func (p *Proxy) SetJournal(journal *QueryJournal) {
+	p.journal = journal
+}
+
+const (
+	defaultPoolWarmSize    = 4
+	defaultPoolMaxErrors   = 3
+	defaultPoolCoolDown    = 5 * time.Second
+	defaultPoolDialTimeout = 5 * time.Second
+)
+
+// SetPoolOptions overrides the upstream connection pool's defaults. Call
+// before ListenAndRelay.
+func (p *Proxy) SetPoolOptions(warmSize, maxErrors int, coolDown, dialTimeout time.Duration) {
+	p.poolWarmSize = warmSize
+	p.poolMaxErrors = maxErrors
+	p.poolCoolDown = coolDown
+	p.poolDialTimeout = dialTimeout
 }
 
 func (p *Proxy) newServerConn() (net.Conn, error) {
-	lastServer := ""
 	retrySleep := 50 * time.Millisecond
+	var lastErr error
 	for retryCount := 7; retryCount > 0; retryCount-- {
-		server := p.servers[0]
-		if l := len(p.servers); l > 1 {
-			server = p.servers[rand.Intn(l-1)]
-		}
-		c, err := net.Dial("tcp", server)
+		c, err := p.pool.Get()
 		if err == nil {
 			return c, nil
 		}
-		log.Println("Unable to connect to", server, ":", err, "retrying in", retrySleep/time.Microsecond)
+		lastErr = err
+		log.Println("Unable to get an upstream connection:", err, "retrying in", retrySleep/time.Microsecond)
 		time.Sleep(retrySleep)
 		retrySleep = retrySleep * 2
-		lastServer = server
 	}
-	return nil, fmt.Errorf("Couldn't connect to %s", lastServer)
+	return nil, fmt.Errorf("Couldn't connect to an upstream server: %s", lastErr)
+}
+
+// Shutdown drains the upstream connection pool, letting in-flight queries
+// finish (up to timeout) before returning. Callers should invoke this on
+// SIGTERM before exiting.
+func (p *Proxy) Shutdown(timeout time.Duration) {
+	p.pool.Drain(timeout)
 }
 
 func (p *Proxy) handleClientConnection(c net.Conn) {
+	wrapped, err := wrapProxyProtocol(c, p.proxyProtocolMode)
+	if err != nil {
+		log.Println("PROXY protocol error:", err)
+		c.Close()
+		return
+	}
+	c = wrapped
+
 	s, err := p.newServerConn()
 	if err != nil {
 		log.Println("Server failure", err)
@@ -91,8 +142,10 @@ func (p *Proxy) handleClientConnection(c net.Conn) {
 		return
 	}
 
+	clientConnections.Inc()
 	defer func() {
-		s.Close()
+		p.pool.Put(s, true)
+		clientConnections.Dec()
 	}()
 
 	if conn, ok := c.(*net.TCPConn); ok {
@@ -112,7 +165,7 @@ func (p *Proxy) handleClientConnection(c net.Conn) {
 		if err != nil {
 			log.Println(err, "reconnecting...")
 			// reconnect cos the server will be trying to write to the client
-			s.Close()
+			p.pool.Put(s, false)
 			s, _ = p.newServerConn()
 		}
 	}
@@ -146,6 +199,10 @@ func (p *Proxy) handleMessage(h *messageHeader, client, server net.Conn) error {
 		return p.handleQueryRequest(h, client, server)
 	}
 
+	if h.OpCode == OpMsg {
+		return p.handleOpMsgRequest(h, client, server)
+	}
+
 	if err := h.WriteTo(server); err != nil {
 		log.Println(err)
 		return err
@@ -188,6 +245,7 @@ func (p *Proxy) handleQueryRequest(h *messageHeader, client, server io.ReadWrite
 		return err
 	}
 	fullCollectionString := string(fullCollectionName[:len(fullCollectionName)-1])
+	database, collection := p.splitDatabaseCollection(fullCollectionString)
 
 	parts = append(parts, fullCollectionName)
 	var twoInt32 [8]byte
@@ -205,21 +263,37 @@ func (p *Proxy) handleQueryRequest(h *messageHeader, client, server io.ReadWrite
 
 	var q bson.D
 	if err := bson.Unmarshal(queryDoc, &q); err != nil {
+		bsonParseErrors.Inc()
 		log.Println(err)
 		return err
 	}
 
 	if !(bytes.HasSuffix(fullCollectionName, cmdCollectionSuffix) || bytes.HasSuffix(fullCollectionName, indexCollectionSuffix) || bytes.Contains(fullCollectionName, systemCollection)) && len(q) > 0 {
 		log.Printf("[%s] Checking OpQuery for %s: %s", remoteAddr, fullCollectionString, spew.Sdump(q))
-		database, collection := p.splitDatabaseCollection(fullCollectionString)
-		if !p.checkForIndex(database, collection, q) {
+		var sort bson.D
+		if orderby, isD := p.getKey(q, "orderby").(bson.D); isD {
+			sort = orderby
+		}
+		if !p.checkForIndex(database, collection, q, sort, false) {
 			log.Printf("[%s] Rejecting query", remoteAddr)
+			queriesTotal.WithLabelValues(database, collection, "rejected", "no_index").Inc()
+			if p.journal != nil {
+				p.journal.Record(JournalRecord{
+					RemoteAddr: remoteAddr,
+					Database:   database,
+					Collection: collection,
+					Query:      bsonDocToMap(q),
+					IndexField: p.firstIndexableField(q),
+					Outcome:    JournalOutcomeRejected,
+				})
+			}
 			// pinched the code value from https://github.com/mongodb/mongo/blob/master/docs/errors.md
 			return p.sendErrorToClient(h, client, fmt.Errorf("No index was found that could be used for your query try db.%s.getIndexes()", collection), 17357)
 		}
+		queriesTotal.WithLabelValues(database, collection, "accepted", "").Inc()
 
 		// Tag the query so it's easier to find later
-		queryID := uuid.New("Q")
+		queryID = uuid.New("Q")
 		q = p.mutateQuery(q, remoteAddr, queryID)
 		newdoc, _ := bson.Marshal(q)
 
@@ -253,6 +327,7 @@ func (p *Proxy) handleQueryRequest(h *messageHeader, client, server io.ReadWrite
 	queryStart := time.Now()
 	if err := copyMessage(client, server); err != nil {
 		duration := time.Now().Sub(queryStart)
+		queryDuration.WithLabelValues(database, collection).Observe(duration.Seconds())
 
 		f := bson.M{"op": "query", "ns": fullCollectionString}
 		if queryID == "" {
@@ -277,6 +352,18 @@ func (p *Proxy) handleQueryRequest(h *messageHeader, client, server io.ReadWrite
 				if err != nil {
 					log.Println(err)
 				}
+				queriesKilled.WithLabelValues(database, collection).Inc()
+				if p.journal != nil {
+					p.journal.Record(JournalRecord{
+						RemoteAddr:      remoteAddr,
+						QueryID:         queryID,
+						Database:        database,
+						Collection:      collection,
+						Query:           bsonDocToMap(q),
+						Outcome:         JournalOutcomeKilled,
+						DurationSeconds: duration.Seconds(),
+					})
+				}
 			}
 
 			if conn, ok := client.(net.Conn); ok {
@@ -295,6 +382,20 @@ func (p *Proxy) handleQueryRequest(h *messageHeader, client, server io.ReadWrite
 		return err
 	}
 
+	duration := time.Now().Sub(queryStart)
+	queryDuration.WithLabelValues(database, collection).Observe(duration.Seconds())
+	if p.journal != nil && p.journal.IsSlow(duration) {
+		p.journal.Record(JournalRecord{
+			RemoteAddr:      remoteAddr,
+			QueryID:         queryID,
+			Database:        database,
+			Collection:      collection,
+			Query:           bsonDocToMap(q),
+			Outcome:         JournalOutcomeSlow,
+			DurationSeconds: duration.Seconds(),
+		})
+	}
+
 	return nil
 }
 
@@ -350,28 +451,23 @@ func (p *Proxy) flattenQuery(d interface{}, name []string, result bson.M) {
 	}
 }
 
-func (p *Proxy) checkForIndex(databaseName, collectionName string, query bson.D) bool {
+func (p *Proxy) checkForIndex(databaseName, collectionName string, query, sort bson.D, hasHint bool) bool {
 	c := p.backChannel.Clone().DB(databaseName).C(collectionName)
 	count, err := c.Count()
 	if err != nil {
 		fmt.Println(err)
 	}
-	// No point index checking an empty collection - it may not even exist
-	if count == 0 {
-		return true
-	}
 	indexes, err := c.Indexes()
 	if err != nil {
 		fmt.Println(err)
 	}
-	indexFieldName := p.firstIndexableField(query)
-	for _, index := range indexes {
-		if strings.EqualFold(strings.Trim(index.Key[0], "-"), indexFieldName) {
-			return true
-		}
+
+	ok, reason := p.policy.Check(databaseName, collectionName, query, sort, hasHint, indexes, int64(count))
+	if !ok {
+		log.Printf("Policy rejected %s.%s: %s", databaseName, collectionName, reason)
 	}
 
-	return false
+	return ok
 }
 
 func (p *Proxy) firstIndexableField(query bson.D) string {
@@ -473,6 +569,30 @@ func (p *Proxy) ListenAndRelay(proto, listen string) error {
 		return err
 	}
 
+	warmSize, maxErrors, coolDown, dialTimeout := p.poolWarmSize, p.poolMaxErrors, p.poolCoolDown, p.poolDialTimeout
+	if warmSize == 0 {
+		warmSize = defaultPoolWarmSize
+	}
+	if maxErrors == 0 {
+		maxErrors = defaultPoolMaxErrors
+	}
+	if coolDown == 0 {
+		coolDown = defaultPoolCoolDown
+	}
+	if dialTimeout == 0 {
+		dialTimeout = defaultPoolDialTimeout
+	}
+	p.pool = NewServerPool(p.servers, warmSize, maxErrors, coolDown, dialTimeout)
+	p.pool.SetPingCredentials(p.user, p.pass, p.authdb)
+
+	if p.metricsListen != "" {
+		go func() {
+			if err := ServeMetrics(p.metricsListen); err != nil {
+				log.Println("Metrics server error:", err)
+			}
+		}()
+	}
+
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -482,7 +602,7 @@ func (p *Proxy) ListenAndRelay(proto, listen string) error {
 	}
 }
 
-func newProxy(servers []string, user, pass, authdb string, messageTimeout, clientIdleTimeout time.Duration) *Proxy {
+func newProxy(servers []string, user, pass, authdb string, messageTimeout, clientIdleTimeout time.Duration, proxyProtocolMode ProxyProtocolMode, metricsListen string) *Proxy {
 	return &Proxy{
 		servers:           servers,
 		messageTimeout:    messageTimeout,
@@ -490,5 +610,8 @@ func newProxy(servers []string, user, pass, authdb string, messageTimeout, clien
 		user:              user,
 		pass:              pass,
 		authdb:            authdb,
+		proxyProtocolMode: proxyProtocolMode,
+		metricsListen:     metricsListen,
+		policy:            NewDefaultPolicy(nil),
 	}
 }
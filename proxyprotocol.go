@@ -0,0 +1,216 @@
+/*
+ *   Queryguard - Simple 1:1 proxy for mongodb that prevents people from running queries that won't use indexes
+ *   Copyright (c) 2016 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolMode controls whether queryguard expects a PROXY protocol
+// (v1 or v2) header in front of each accepted connection, for deployments
+// sitting behind an L4 load balancer such as HAProxy, ELB or NLB.
+type ProxyProtocolMode int
+
+const (
+	ProxyProtocolOff ProxyProtocolMode = iota
+	ProxyProtocolOptional
+	ProxyProtocolRequired
+)
+
+// ParseProxyProtocolMode maps the --proxy-protocol flag value to a
+// ProxyProtocolMode.
+func ParseProxyProtocolMode(s string) (ProxyProtocolMode, error) {
+	switch strings.ToLower(s) {
+	case "", "off":
+		return ProxyProtocolOff, nil
+	case "optional":
+		return ProxyProtocolOptional, nil
+	case "required":
+		return ProxyProtocolRequired, nil
+	default:
+		return ProxyProtocolOff, fmt.Errorf("unknown proxy protocol mode %q", s)
+	}
+}
+
+var (
+	proxyProtocolV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+	errNoProxyProtocolHeader = errors.New("no PROXY protocol header present")
+)
+
+// proxyProtocolConn wraps a net.Conn so RemoteAddr reports the client
+// address parsed from a PROXY protocol header rather than the load
+// balancer's own socket address.
+type proxyProtocolConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+// bufferedConn reattaches the bufio.Reader used to peek/consume a PROXY
+// protocol header to the connection's Read method, so nothing downstream
+// loses the bytes that were buffered but not part of the header.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// wrapProxyProtocol reads, and in required mode enforces, a PROXY protocol
+// header from the front of c, returning a net.Conn whose RemoteAddr
+// reflects the real client address.
+func wrapProxyProtocol(c net.Conn, mode ProxyProtocolMode) (net.Conn, error) {
+	if mode == ProxyProtocolOff {
+		return c, nil
+	}
+
+	br := bufio.NewReader(c)
+	wrapped := &bufferedConn{Conn: c, r: br}
+
+	addr, err := readProxyProtocolHeader(br)
+	if err != nil {
+		if err == errNoProxyProtocolHeader {
+			if mode == ProxyProtocolRequired {
+				return nil, fmt.Errorf("PROXY protocol required but no valid header found")
+			}
+			return wrapped, nil
+		}
+		return nil, err
+	}
+
+	return &proxyProtocolConn{Conn: wrapped, remoteAddr: addr}, nil
+}
+
+func readProxyProtocolHeader(r *bufio.Reader) (net.Addr, error) {
+	if peek, err := r.Peek(len(proxyProtocolV2Signature)); err == nil && bytes.Equal(peek, proxyProtocolV2Signature) {
+		return readProxyProtocolV2(r)
+	}
+
+	if peek, err := r.Peek(5); err == nil && string(peek) == "PROXY" {
+		return readProxyProtocolV1(r)
+	}
+
+	return nil, errNoProxyProtocolHeader
+}
+
+// readProxyProtocolV1 parses the text header, e.g.
+// "PROXY TCP4 192.168.1.1 192.168.1.2 56324 443\r\n".
+func readProxyProtocolV1(r *bufio.Reader) (net.Addr, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("reading PROXY v1 header: %s", err)
+	}
+	line = strings.TrimRight(line, "\r\n")
+
+	fields := strings.Fields(line)
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+
+	if fields[1] == "UNKNOWN" {
+		return nil, errNoProxyProtocolHeader
+	}
+
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("malformed PROXY v1 header: %q", line)
+	}
+
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source port: %q", fields[4])
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("malformed PROXY v1 source address: %q", fields[2])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyProtocolV2 parses the binary header: the 12-byte signature
+// (only peeked by the caller, so read again here), a version/command byte, a
+// family/protocol byte, a 2-byte address block length, then the address
+// block itself.
+func readProxyProtocolV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 header: %s", err)
+	}
+
+	verCmd := header[12]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", verCmd>>4)
+	}
+	cmd := verCmd & 0x0F
+
+	family := header[13] >> 4
+	addrLen := binary.BigEndian.Uint16(header[14:16])
+
+	addr := make([]byte, addrLen)
+	if _, err := io.ReadFull(r, addr); err != nil {
+		return nil, fmt.Errorf("reading PROXY v2 address block: %s", err)
+	}
+
+	// PROXY protocol "LOCAL" connections (health checks, keep-alives) carry
+	// no real client address, so they are reported as having no header:
+	// optional mode keeps the socket's own RemoteAddr, and required mode
+	// rejects the connection.
+	if cmd == 0 {
+		return nil, errNoProxyProtocolHeader
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if len(addr) < 12 {
+			return nil, fmt.Errorf("short PROXY v2 IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addr[0:4]),
+			Port: int(binary.BigEndian.Uint16(addr[8:10])),
+		}, nil
+
+	case 0x2: // AF_INET6
+		if len(addr) < 36 {
+			return nil, fmt.Errorf("short PROXY v2 IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addr[0:16]),
+			Port: int(binary.BigEndian.Uint16(addr[32:34])),
+		}, nil
+
+	default:
+		return nil, errNoProxyProtocolHeader
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ *   Queryguard - Simple 1:1 proxy for mongodb that prevents people from running queries that won't use indexes
+ *   Copyright (c) 2016 Shannon Wynter, Ladbrokes Digital Australia Pty Ltd.
+ *
+ *   This program is free software: you can redistribute it and/or modify
+ *   it under the terms of the GNU General Public License as published by
+ *   the Free Software Foundation, either version 3 of the License, or
+ *   (at your option) any later version.
+ *
+ *   This program is distributed in the hope that it will be useful,
+ *   but WITHOUT ANY WARRANTY; without even the implied warranty of
+ *   MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ *   GNU General Public License for more details.
+ *
+ *   You should have received a copy of the GNU General Public License
+ *   along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ *
+ *   Author: Shannon Wynter <http://fremnet.net/contact>
+ */
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"testing"
+)
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    []byte
+		wantErr  error // non-nil: expect exactly this error
+		wantIP   string
+		wantPort int
+	}{
+		{
+			name:    "not a PROXY header",
+			input:   []byte("GET / HTTP/1.1\r\n"),
+			wantErr: errNoProxyProtocolHeader,
+		},
+		{
+			name:  "truncated v1 line with no newline",
+			input: []byte("PROXY TCP4 192.168.1.1 192.168.1.2 56324 443"),
+		},
+		{
+			name:  "v1 missing fields",
+			input: []byte("PROXY TCP4 192.168.1.1\r\n"),
+		},
+		{
+			name:  "v1 bad source port",
+			input: []byte("PROXY TCP4 192.168.1.1 192.168.1.2 abc 443\r\n"),
+		},
+		{
+			name:  "v1 bad source address",
+			input: []byte("PROXY TCP4 not-an-ip 192.168.1.2 56324 443\r\n"),
+		},
+		{
+			name:     "valid v1 header",
+			input:    []byte("PROXY TCP4 192.168.1.1 192.168.1.2 56324 443\r\n"),
+			wantIP:   "192.168.1.1",
+			wantPort: 56324,
+		},
+		{
+			name:  "truncated v2 header",
+			input: append(append([]byte{}, proxyProtocolV2Signature...), 0x21, 0x11),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			addr, err := readProxyProtocolHeader(bufio.NewReader(bytes.NewReader(tt.input)))
+
+			if tt.wantErr != nil {
+				if err != tt.wantErr {
+					t.Fatalf("expected error %v, got %v", tt.wantErr, err)
+				}
+				return
+			}
+
+			if tt.wantIP == "" {
+				if err == nil {
+					t.Fatalf("expected a parse error, got addr %v", addr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			tcpAddr, ok := addr.(*net.TCPAddr)
+			if !ok {
+				t.Fatalf("expected *net.TCPAddr, got %T", addr)
+			}
+			if tcpAddr.IP.String() != tt.wantIP || tcpAddr.Port != tt.wantPort {
+				t.Fatalf("got %s:%d, want %s:%d", tcpAddr.IP, tcpAddr.Port, tt.wantIP, tt.wantPort)
+			}
+		})
+	}
+}